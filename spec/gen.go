@@ -1,13 +1,17 @@
 package main
 
 import (
+  "encoding/binary"
   "encoding/xml"
   "errors"
+  "flag"
   "fmt"
   "io/ioutil"
   "log"
   "os"
+  "path/filepath"
   "regexp"
+  "strconv"
   "strings"
   "bytes"
   "text/template"
@@ -31,6 +35,35 @@ var amqpTypeToNative = map[string]string{
   "longstr":    "string",
 }
 
+// tableType describes one AMQP field-table value tag: the wire tag octet,
+// the Go type it round-trips through, and the put/get helpers in table.go
+// that encode and decode a value of that type. Adding support for a new
+// tag is a one-line addition here plus the matching put/get helpers;
+// table.go's dispatch switches are generated from this slice.
+type tableType struct {
+  Tag string // Go char literal for the wire tag octet, e.g. "'t'"
+  Go  string // Go type used in the encode type-switch case
+  Put string // func(buf *Buffer, v Go) error
+  Get string // func(buf *Buffer) (interface{}, error)
+}
+
+var tableTypes = []tableType{
+  {Tag: "'t'", Go: "bool", Put: "putBool", Get: "getBool"},
+  {Tag: "'b'", Go: "int8", Put: "putInt8", Get: "getInt8"},
+  {Tag: "'B'", Go: "uint8", Put: "putUint8", Get: "getUint8"},
+  {Tag: "'s'", Go: "int16", Put: "putInt16", Get: "getInt16"},
+  {Tag: "'u'", Go: "uint16", Put: "putUint16", Get: "getUint16"},
+  {Tag: "'I'", Go: "int32", Put: "putInt32", Get: "getInt32"},
+  {Tag: "'i'", Go: "uint32", Put: "putUint32", Get: "getUint32"},
+  {Tag: "'l'", Go: "int64", Put: "putInt64", Get: "getInt64"},
+  {Tag: "'f'", Go: "float32", Put: "putFloat32", Get: "getFloat32"},
+  {Tag: "'d'", Go: "float64", Put: "putFloat64", Get: "getFloat64"},
+  {Tag: "'D'", Go: "Decimal", Put: "putDecimal", Get: "getDecimal"},
+  {Tag: "'S'", Go: "string", Put: "putLongstr", Get: "getLongstr"},
+  {Tag: "'x'", Go: "[]byte", Put: "putBytes", Get: "getBytes"},
+  {Tag: "'T'", Go: "time.Time", Put: "putTimestamp", Get: "getTimestamp"},
+}
+
 type Rule struct {
   Name string   `xml:"name,attr"`
   Docs []string `xml:"doc"`
@@ -62,17 +95,23 @@ type Field struct {
   Asserts  []Assert `xml:"assert"`
 }
 
+// MethodResponse is the <response> child of a <method>, naming the method
+// that answers it.
+type MethodResponse struct {
+  Name string `xml:"name,attr"`
+}
+
 type Method struct {
-  Name        string    `xml:"name,attr"`
-  Response    string    `xml:"response>name,attr"`
-  Synchronous bool      `xml:"synchronous,attr"`
-  Content     bool      `xml:"content,attr"`
-  Index       string    `xml:"index,attr"`
-  Label       string    `xml:"label,attr"`
-  Docs        []Doc     `xml:"doc"`
-  Rules       []Rule    `xml:"rule"`
-  Fields      []Field   `xml:"field"`
-  Chassis     []Chassis `xml:"chassis"`
+  Name        string         `xml:"name,attr"`
+  Response    MethodResponse `xml:"response"`
+  Synchronous bool           `xml:"synchronous,attr"`
+  Content     bool           `xml:"content,attr"`
+  Index       string         `xml:"index,attr"`
+  Label       string         `xml:"label,attr"`
+  Docs        []Doc          `xml:"doc"`
+  Rules       []Rule         `xml:"rule"`
+  Fields      []Field        `xml:"field"`
+  Chassis     []Chassis      `xml:"chassis"`
 }
 
 type Class struct {
@@ -111,8 +150,7 @@ type Amqp struct {
 }
 
 type renderer struct {
-  Root       Amqp
-  bitcounter int
+  Root Amqp
 }
 
 type fieldset struct {
@@ -139,8 +177,202 @@ var (
     "fmt"
     "encoding/binary"
     "io"
+    {{if $.NeedsTime}}"time"
+    {{end}}
   )
 
+  // Buffer is an append-oriented byte buffer used by the generated write,
+  // read and MarshalAppend methods. Encoding appends to an owned []byte;
+  // decoding reads from a caller-owned []byte without copying the slice
+  // itself, though decoded strings are copied out of it.
+  type Buffer struct {
+    buf []byte
+    off int
+
+    bits    byte
+    pending bool
+  }
+
+  // NewBuffer wraps buf for decoding, starting at offset 0.
+  func NewBuffer(buf []byte) *Buffer {
+    return &Buffer{buf: buf}
+  }
+
+  // Bytes returns the bytes accumulated so far when encoding, or the
+  // underlying slice passed to NewBuffer when decoding.
+  func (b *Buffer) Bytes() []byte {
+    return b.buf
+  }
+
+  func (b *Buffer) PutUint8(v uint8) {
+    b.buf = append(b.buf, v)
+  }
+
+  func (b *Buffer) PutUint16(v uint16) {
+    b.buf = append(b.buf, byte(v>>8), byte(v))
+  }
+
+  func (b *Buffer) PutUint32(v uint32) {
+    b.buf = append(b.buf, byte(v>>24), byte(v>>16), byte(v>>8), byte(v))
+  }
+
+  func (b *Buffer) PutUint64(v uint64) {
+    b.buf = append(b.buf,
+      byte(v>>56), byte(v>>48), byte(v>>40), byte(v>>32),
+      byte(v>>24), byte(v>>16), byte(v>>8), byte(v))
+  }
+
+  // PutBits ORs bit into the bit octet pending at pos, resetting the octet
+  // when pos is 0. Call FlushBits once the run of bit fields ends.
+  func (b *Buffer) PutBits(bit bool, pos int) {
+    if pos == 0 {
+      b.bits = 0
+    }
+    if bit {
+      b.bits |= 1 << uint(pos)
+    }
+    b.pending = true
+  }
+
+  // FlushBits appends the pending bit octet, if any. Safe to call when
+  // there is nothing pending.
+  func (b *Buffer) FlushBits() {
+    if b.pending {
+      b.buf = append(b.buf, b.bits)
+      b.bits, b.pending = 0, false
+    }
+  }
+
+  // PutShortstr appends a string prefixed with its single-byte length.
+  func (b *Buffer) PutShortstr(s string) error {
+    if len(s) > 255 {
+      return fmt.Errorf("amqp: shortstr longer than 255 bytes: %d", len(s))
+    }
+    b.PutUint8(uint8(len(s)))
+    b.buf = append(b.buf, s...)
+    return nil
+  }
+
+  // PutLongstr appends a string prefixed with its uint32 byte length,
+  // reserving the length and backpatching it once the string is written.
+  func (b *Buffer) PutLongstr(s string) {
+    start := len(b.buf)
+    b.PutUint32(0)
+    b.buf = append(b.buf, s...)
+    binary.BigEndian.PutUint32(b.buf[start:], uint32(len(b.buf)-start-4))
+  }
+
+  // PutTable reserves a uint32 length prefix, writes t's fields, and
+  // backpatches the length once the encoded size is known.
+  func (b *Buffer) PutTable(t Table) error {
+    return b.putTable(t, false)
+  }
+
+  func (b *Buffer) putTable(t Table, deterministic bool) error {
+    start := len(b.buf)
+    b.PutUint32(0)
+    if err := writeTableFields(b, t, deterministic); err != nil {
+      return err
+    }
+    binary.BigEndian.PutUint32(b.buf[start:], uint32(len(b.buf)-start-4))
+    return nil
+  }
+
+  func (b *Buffer) GetUint8() (v uint8, err error) {
+    if b.off+1 > len(b.buf) {
+      return 0, io.ErrUnexpectedEOF
+    }
+    v = b.buf[b.off]
+    b.off++
+    return
+  }
+
+  func (b *Buffer) GetUint16() (v uint16, err error) {
+    if b.off+2 > len(b.buf) {
+      return 0, io.ErrUnexpectedEOF
+    }
+    v = binary.BigEndian.Uint16(b.buf[b.off:])
+    b.off += 2
+    return
+  }
+
+  func (b *Buffer) GetUint32() (v uint32, err error) {
+    if b.off+4 > len(b.buf) {
+      return 0, io.ErrUnexpectedEOF
+    }
+    v = binary.BigEndian.Uint32(b.buf[b.off:])
+    b.off += 4
+    return
+  }
+
+  func (b *Buffer) GetUint64() (v uint64, err error) {
+    if b.off+8 > len(b.buf) {
+      return 0, io.ErrUnexpectedEOF
+    }
+    v = binary.BigEndian.Uint64(b.buf[b.off:])
+    b.off += 8
+    return
+  }
+
+  // GetBits reads the bit octet once, at pos 0, caching it for the bits
+  // at later positions read from the same octet.
+  func (b *Buffer) GetBits(pos int) (bit bool, err error) {
+    if pos == 0 {
+      if b.bits, err = b.GetUint8(); err != nil {
+        return
+      }
+    }
+    return b.bits&(1<<uint(pos)) > 0, nil
+  }
+
+  // GetShortstr bounds-checks and slices the underlying buffer, returning
+  // the bytes as a string; the conversion copies them.
+  func (b *Buffer) GetShortstr() (s string, err error) {
+    n, err := b.GetUint8()
+    if err != nil {
+      return
+    }
+    if b.off+int(n) > len(b.buf) {
+      return "", io.ErrUnexpectedEOF
+    }
+    s = string(b.buf[b.off : b.off+int(n)])
+    b.off += int(n)
+    return
+  }
+
+  // GetLongstr bounds-checks and slices the underlying buffer, returning
+  // the bytes as a string; the conversion copies them.
+  func (b *Buffer) GetLongstr() (s string, err error) {
+    n, err := b.GetUint32()
+    if err != nil {
+      return
+    }
+    if b.off+int(n) > len(b.buf) {
+      return "", io.ErrUnexpectedEOF
+    }
+    s = string(b.buf[b.off : b.off+int(n)])
+    b.off += int(n)
+    return
+  }
+
+  // GetTable reads a uint32-prefixed table and bounds-checks it against
+  // the remaining buffer before decoding its fields.
+  func (b *Buffer) GetTable() (t Table, err error) {
+    size, err := b.GetUint32()
+    if err != nil {
+      return
+    }
+    if b.off+int(size) > len(b.buf) {
+      return t, io.ErrUnexpectedEOF
+    }
+    end := b.off + int(size)
+    if t, err = readTableFields(b, end); err != nil {
+      return
+    }
+    b.off = end
+    return
+  }
+
   const (
   {{range .Constants}}
   {{range .Doc}}
@@ -148,6 +380,72 @@ var (
   {{end}}{{.Name | camel}} = {{.Value}} {{end}}
   )
 
+  // FieldDescriptor describes a single field of a generated method struct,
+  // as found in the AMQP 0-9-1 spec used to generate this file.
+  type FieldDescriptor struct {
+    Name       string
+    AmqpType   string
+    NativeType string
+    Reserved   bool
+  }
+
+  // MethodDescriptor describes a generated method struct without requiring
+  // the caller to import or type-assert the concrete struct.
+  type MethodDescriptor struct {
+    Name        string
+    ClassId     uint16
+    MethodId    uint16
+    Content     bool
+    Synchronous bool
+    Response    uint16
+    Fields      []FieldDescriptor
+  }
+
+  func methodKey(classId, methodId uint16) uint32 {
+    return uint32(classId)<<16 | uint32(methodId)
+  }
+
+  var methodDescriptors = map[uint32]*MethodDescriptor{}
+
+  // NewMethod returns a zero-value method struct for the given class and
+  // method id, or false if no such method is known to this package.
+  func NewMethod(classId, methodId uint16) (Method, bool) {
+    switch classId {
+    {{range .Classes}}
+    {{$class := .}}
+    case {{.Index}}:
+      switch methodId {
+      {{range .Methods}}
+      case {{.Index}}:
+        return &{{camel $class.Name .Name}}{}, true
+      {{end}}
+      }
+    {{end}}
+    }
+    return nil, false
+  }
+
+  func init() {
+    {{range .Classes}}
+    {{$class := .}}
+    {{range .Methods}}
+    methodDescriptors[methodKey({{$class.Index}}, {{.Index}})] = &MethodDescriptor{
+      Name:        "{{$class.Name}}.{{.Name}}",
+      ClassId:     {{$class.Index}},
+      MethodId:    {{.Index}},
+      Content:     {{.Content}},
+      Synchronous: {{.Synchronous}},
+      Response:    {{$.ResponseMethodId $class .}},
+      Fields: []FieldDescriptor{
+        {{range .Fields}}
+        {Name: "{{$.FieldName .}}", AmqpType: "{{$.FieldType .}}", NativeType: "{{$.FieldType . | $.NativeType}}", Reserved: {{.Reserved}}},
+        {{end}}
+      },
+    }
+    {{end}}
+    {{end}}
+  }
+
   {{range .Classes}}
     {{$class := .}}
     {{range .Methods}}
@@ -178,147 +476,539 @@ var (
         me.Properties, me.Body = properties, body
       }
 			{{end}}
-      func (me *{{$struct}}) write(w io.Writer) (err error) {
+      func (me *{{$struct}}) write(buf *Buffer) (err error) {
         {{.Fields | $.Fieldsets | $.Partial "enc-"}}
         return
       }
 
-      func (me *{{$struct}}) read(r io.Reader) (err error) {
+      func (me *{{$struct}}) read(buf *Buffer) (err error) {
         {{.Fields | $.Fieldsets | $.Partial "dec-"}}
         return
       }
+
+      // MarshalAppend appends the wire encoding of me to dst and returns
+      // the extended slice, allocating only when dst's capacity is short.
+      func (me *{{$struct}}) MarshalAppend(dst []byte) ([]byte, error) {
+        buf := &Buffer{buf: dst}
+        if err := me.write(buf); err != nil {
+          return nil, err
+        }
+        return buf.buf, nil
+      }
+
+      // Has reports whether {{$struct}} carries a field of the given name.
+      func (me *{{$struct}}) Has(name string) bool {
+        switch name {
+        {{range .Fields}}case "{{$.FieldName .}}":
+          return true
+        {{end}}
+        }
+        return false
+      }
+
+      // Get returns the value of the named field, or nil if {{$struct}}
+      // has no such field.
+      func (me *{{$struct}}) Get(name string) interface{} {
+        switch name {
+        {{range .Fields}}case "{{$.FieldName .}}":
+          return me.{{$.FieldName .}}
+        {{end}}
+        }
+        return nil
+      }
+
+      // Set assigns the named field from value, returning an error if the
+      // field is unknown or value's dynamic type is not exactly the field's
+      // type (an assignable value of another type is rejected).
+      func (me *{{$struct}}) Set(name string, value interface{}) (err error) {
+        switch name {
+        {{range .Fields}}case "{{$.FieldName .}}":
+          v, ok := value.({{$.FieldType . | $.NativeType}})
+          if !ok {
+            return fmt.Errorf("amqp: cannot set {{$struct}}.%s: expected %T, got %T", name, me.{{$.FieldName .}}, value)
+          }
+          me.{{$.FieldName .}} = v
+        {{end}}
+        default:
+          return fmt.Errorf("amqp: {{$struct}} has no field %s", name)
+        }
+        return nil
+      }
+
+      // Range calls fn for each field of {{$struct}} in declared order,
+      // stopping early if fn returns false.
+      func (me *{{$struct}}) Range(fn func(FieldDescriptor, interface{}) bool) {
+        for _, d := range methodDescriptors[methodKey({{$class.Index}}, {{$method.Index}})].Fields {
+          if !fn(d, me.Get(d.Name)) {
+            return
+          }
+        }
+      }
     {{end}}
   {{end}}
 
   func (me *Framer) parseMethodFrame(channel uint16, size uint32) (frame Frame, err error) {
+    body := make([]byte, size)
+    if _, err = io.ReadFull(me.r, body); err != nil {
+      return
+    }
+
+    buf := NewBuffer(body)
+
     mf := &MethodFrame {
       ChannelId: channel,
     }
 
-    if err = binary.Read(me.r, binary.BigEndian, &mf.ClassId); err != nil {
+    if mf.ClassId, err = buf.GetUint16(); err != nil {
       return
     }
 
-    if err = binary.Read(me.r, binary.BigEndian, &mf.MethodId); err != nil {
+    if mf.MethodId, err = buf.GetUint16(); err != nil {
       return
     }
 
-    switch mf.ClassId {
-    {{range .Classes}}
-    {{$class := .}}
-    case {{.Index}}: // {{.Name}}
-      switch mf.MethodId {
-      {{range .Methods}}
-      case {{.Index}}: // {{$class.Name}} {{.Name}}
-        //fmt.Println("NextMethod: class:{{$class.Index}} method:{{.Index}}")
-        method := &{{camel $class.Name .Name}}{}
-        if err = method.read(me.r); err != nil {
-          return
-        }
-        mf.Method = method
-      {{end}}
-      default:
-        return nil, fmt.Errorf("Bad method frame, unknown method %d for class %d", mf.MethodId, mf.ClassId)
-      }
-    {{end}}
-    default:
-      return nil, fmt.Errorf("Bad method frame, unknown class %d", mf.ClassId)
+    method, ok := NewMethod(mf.ClassId, mf.MethodId)
+    if !ok {
+      return nil, fmt.Errorf("Bad method frame, unknown method %d for class %d", mf.MethodId, mf.ClassId)
+    }
+
+    if err = method.read(buf); err != nil {
+      return
     }
 
+    mf.Method = method
+
     return mf, nil
   }
   {{end}}
 
   {{define "enc-bit"}}
-    var bits byte
-    {{range $off, $field := .Fields}}
-    if me.{{$field | $.FieldName}} { bits |= 1 << {{$off}} }
-    {{end}}
-    if err = binary.Write(w, binary.BigEndian, bits); err != nil { return }
+    {{range $off, $field := .Fields}} buf.PutBits(me.{{$field | $.FieldName}}, {{$off}})
+    {{end}} buf.FlushBits()
   {{end}}
   {{define "enc-octet"}}
-    {{range .Fields}} if err = binary.Write(w, binary.BigEndian, me.{{. | $.FieldName}}); err != nil { return }
+    {{range .Fields}} buf.PutUint8(me.{{. | $.FieldName}})
     {{end}}
   {{end}}
   {{define "enc-shortshort"}}
-    {{range .Fields}} if err = binary.Write(w, binary.BigEndian, me.{{. | $.FieldName}}); err != nil { return }
+    {{range .Fields}} buf.PutUint8(me.{{. | $.FieldName}})
     {{end}}
   {{end}}
   {{define "enc-short"}}
-    {{range .Fields}} if err = binary.Write(w, binary.BigEndian, me.{{. | $.FieldName}}); err != nil { return }
+    {{range .Fields}} buf.PutUint16(me.{{. | $.FieldName}})
     {{end}}
   {{end}}
   {{define "enc-long"}}
-    {{range .Fields}} if err = binary.Write(w, binary.BigEndian, me.{{. | $.FieldName}}); err != nil { return }
+    {{range .Fields}} buf.PutUint32(me.{{. | $.FieldName}})
     {{end}}
   {{end}}
   {{define "enc-longlong"}}
-    {{range .Fields}} if err = binary.Write(w, binary.BigEndian, me.{{. | $.FieldName}}); err != nil { return }
+    {{range .Fields}} buf.PutUint64(me.{{. | $.FieldName}})
     {{end}}
   {{end}}
   {{define "enc-timestamp"}}
-    {{range .Fields}} if err = writeTimestamp(w, me.{{. | $.FieldName}}); err != nil { return }
+    {{range .Fields}} buf.PutUint64(uint64(me.{{. | $.FieldName}}.Unix()))
     {{end}}
   {{end}}
   {{define "enc-shortstr"}}
-    {{range .Fields}} if err = writeShortstr(w, me.{{. | $.FieldName}}); err != nil { return }
+    {{range .Fields}} if err = buf.PutShortstr(me.{{. | $.FieldName}}); err != nil { return }
     {{end}}
   {{end}}
   {{define "enc-longstr"}}
-    {{range .Fields}} if err = writeLongstr(w, me.{{. | $.FieldName}}); err != nil { return }
+    {{range .Fields}} buf.PutLongstr(me.{{. | $.FieldName}})
     {{end}}
   {{end}}
   {{define "enc-table"}}
-    {{range .Fields}} if err = writeTable(w, me.{{. | $.FieldName}}); err != nil { return }
+    {{range .Fields}} if err = buf.PutTable(me.{{. | $.FieldName}}); err != nil { return }
     {{end}}
   {{end}}
 
   {{define "dec-bit"}}
-    var bits byte
-    if err = binary.Read(r, binary.BigEndian, &bits); err != nil {
-      return
-    }
-    {{range $off, $field := .Fields}} me.{{$field | $.FieldName}} = (bits & (1 << {{$off}}) > 0)
+    {{range $off, $field := .Fields}} if me.{{$field | $.FieldName}}, err = buf.GetBits({{$off}}); err != nil { return }
     {{end}}
   {{end}}
   {{define "dec-octet"}}
-    {{range .Fields}} if err = binary.Read(r, binary.BigEndian, &me.{{. | $.FieldName}}); err != nil { return }
+    {{range .Fields}} if me.{{. | $.FieldName}}, err = buf.GetUint8(); err != nil { return }
     {{end}}
   {{end}}
   {{define "dec-shortshort"}}
-    {{range .Fields}} if err = binary.Read(r, binary.BigEndian, &me.{{. | $.FieldName}}); err != nil { return }
+    {{range .Fields}} if me.{{. | $.FieldName}}, err = buf.GetUint8(); err != nil { return }
     {{end}}
   {{end}}
   {{define "dec-short"}}
-    {{range .Fields}} if err = binary.Read(r, binary.BigEndian, &me.{{. | $.FieldName}}); err != nil { return }
+    {{range .Fields}} if me.{{. | $.FieldName}}, err = buf.GetUint16(); err != nil { return }
     {{end}}
   {{end}}
   {{define "dec-long"}}
-    {{range .Fields}} if err = binary.Read(r, binary.BigEndian, &me.{{. | $.FieldName}}); err != nil { return }
+    {{range .Fields}} if me.{{. | $.FieldName}}, err = buf.GetUint32(); err != nil { return }
     {{end}}
   {{end}}
   {{define "dec-longlong"}}
-    {{range .Fields}} if err = binary.Read(r, binary.BigEndian, &me.{{. | $.FieldName}}); err != nil { return }
+    {{range .Fields}} if me.{{. | $.FieldName}}, err = buf.GetUint64(); err != nil { return }
     {{end}}
   {{end}}
   {{define "dec-timestamp"}}
-    {{range .Fields}} if me.{{. | $.FieldName}}, err = readTimestamp(r); err != nil { return }
+    {{range .Fields}}
+    {
+      var ts uint64
+      if ts, err = buf.GetUint64(); err != nil { return }
+      me.{{. | $.FieldName}} = time.Unix(int64(ts), 0)
+    }
     {{end}}
   {{end}}
   {{define "dec-shortstr"}}
-    {{range .Fields}} if me.{{. | $.FieldName}}, err = readShortstr(r); err != nil { return }
+    {{range .Fields}} if me.{{. | $.FieldName}}, err = buf.GetShortstr(); err != nil { return }
     {{end}}
   {{end}}
   {{define "dec-longstr"}}
-    {{range .Fields}} if me.{{. | $.FieldName}}, err = readLongstr(r); err != nil { return }
+    {{range .Fields}} if me.{{. | $.FieldName}}, err = buf.GetLongstr(); err != nil { return }
     {{end}}
   {{end}}
   {{define "dec-table"}}
-    {{range .Fields}} if me.{{. | $.FieldName}}, err = readTable(r); err != nil { return }
+    {{range .Fields}} if me.{{. | $.FieldName}}, err = buf.GetTable(); err != nil { return }
     {{end}}
   {{end}}
 
   `))
+
+  tableTemplate = template.Must(template.New("table").Funcs(helpers).Parse(`
+  /* GENERATED FILE - DO NOT EDIT */
+  /* Rebuild from the protocol/gen.go tool */
+
+  package amqp
+
+  import (
+    "encoding/binary"
+    "fmt"
+    "io"
+    "math"
+    "sort"
+    "time"
+  )
+
+  // Decimal represents amqp's decimal field type: value * 10^(-scale).
+  type Decimal struct {
+    Scale uint8
+    Value int32
+  }
+
+  // Table stores user supplied fields of the following types:
+  //
+  //   bool
+  //   byte, int8, uint8
+  //   int16, uint16
+  //   int32, uint32
+  //   int64
+  //   float32, float64
+  //   Decimal
+  //   string
+  //   []byte
+  //   []interface{} - containing any of the above
+  //   Table
+  //   time.Time
+  //   nil
+  //
+  // Functions taking a table will immediately fail when the table contains
+  // a value of an unsupported type.
+  type Table map[string]interface{}
+
+  const (
+    tagVoid  = 'V'
+    tagTable = 'F'
+    tagArray = 'A'
+  )
+
+  func putBool(buf *Buffer, v bool) error {
+    if v {
+      buf.PutUint8(1)
+    } else {
+      buf.PutUint8(0)
+    }
+    return nil
+  }
+
+  func getBool(buf *Buffer) (interface{}, error) {
+    v, err := buf.GetUint8()
+    return v != 0, err
+  }
+
+  func putInt8(buf *Buffer, v int8) error {
+    buf.PutUint8(uint8(v))
+    return nil
+  }
+
+  func getInt8(buf *Buffer) (interface{}, error) {
+    v, err := buf.GetUint8()
+    return int8(v), err
+  }
+
+  func putUint8(buf *Buffer, v uint8) error {
+    buf.PutUint8(v)
+    return nil
+  }
+
+  func getUint8(buf *Buffer) (interface{}, error) {
+    return buf.GetUint8()
+  }
+
+  func putInt16(buf *Buffer, v int16) error {
+    buf.PutUint16(uint16(v))
+    return nil
+  }
+
+  func getInt16(buf *Buffer) (interface{}, error) {
+    v, err := buf.GetUint16()
+    return int16(v), err
+  }
+
+  func putUint16(buf *Buffer, v uint16) error {
+    buf.PutUint16(v)
+    return nil
+  }
+
+  func getUint16(buf *Buffer) (interface{}, error) {
+    return buf.GetUint16()
+  }
+
+  func putInt32(buf *Buffer, v int32) error {
+    buf.PutUint32(uint32(v))
+    return nil
+  }
+
+  func getInt32(buf *Buffer) (interface{}, error) {
+    v, err := buf.GetUint32()
+    return int32(v), err
+  }
+
+  func putUint32(buf *Buffer, v uint32) error {
+    buf.PutUint32(v)
+    return nil
+  }
+
+  func getUint32(buf *Buffer) (interface{}, error) {
+    return buf.GetUint32()
+  }
+
+  func putInt64(buf *Buffer, v int64) error {
+    buf.PutUint64(uint64(v))
+    return nil
+  }
+
+  func getInt64(buf *Buffer) (interface{}, error) {
+    v, err := buf.GetUint64()
+    return int64(v), err
+  }
+
+  func putFloat32(buf *Buffer, v float32) error {
+    buf.PutUint32(math.Float32bits(v))
+    return nil
+  }
+
+  func getFloat32(buf *Buffer) (interface{}, error) {
+    v, err := buf.GetUint32()
+    return math.Float32frombits(v), err
+  }
+
+  func putFloat64(buf *Buffer, v float64) error {
+    buf.PutUint64(math.Float64bits(v))
+    return nil
+  }
+
+  func getFloat64(buf *Buffer) (interface{}, error) {
+    v, err := buf.GetUint64()
+    return math.Float64frombits(v), err
+  }
+
+  func putDecimal(buf *Buffer, v Decimal) error {
+    buf.PutUint8(v.Scale)
+    buf.PutUint32(uint32(v.Value))
+    return nil
+  }
+
+  func getDecimal(buf *Buffer) (interface{}, error) {
+    scale, err := buf.GetUint8()
+    if err != nil {
+      return nil, err
+    }
+    value, err := buf.GetUint32()
+    if err != nil {
+      return nil, err
+    }
+    return Decimal{Scale: scale, Value: int32(value)}, nil
+  }
+
+  func putLongstr(buf *Buffer, v string) error {
+    buf.PutLongstr(v)
+    return nil
+  }
+
+  func getLongstr(buf *Buffer) (interface{}, error) {
+    return buf.GetLongstr()
+  }
+
+  func putBytes(buf *Buffer, v []byte) error {
+    buf.PutUint32(uint32(len(v)))
+    buf.buf = append(buf.buf, v...)
+    return nil
+  }
+
+  func getBytes(buf *Buffer) (interface{}, error) {
+    n, err := buf.GetUint32()
+    if err != nil {
+      return nil, err
+    }
+    if buf.off+int(n) > len(buf.buf) {
+      return nil, io.ErrUnexpectedEOF
+    }
+    v := make([]byte, n)
+    copy(v, buf.buf[buf.off:buf.off+int(n)])
+    buf.off += int(n)
+    return v, nil
+  }
+
+  func putTimestamp(buf *Buffer, v time.Time) error {
+    buf.PutUint64(uint64(v.Unix()))
+    return nil
+  }
+
+  func getTimestamp(buf *Buffer) (interface{}, error) {
+    v, err := buf.GetUint64()
+    if err != nil {
+      return nil, err
+    }
+    return time.Unix(int64(v), 0), nil
+  }
+
+  func writeFieldArray(buf *Buffer, a []interface{}, deterministic bool) error {
+    start := len(buf.buf)
+    buf.PutUint32(0)
+    for _, v := range a {
+      if err := writeFieldValue(buf, v, deterministic); err != nil {
+        return err
+      }
+    }
+    binary.BigEndian.PutUint32(buf.buf[start:], uint32(len(buf.buf)-start-4))
+    return nil
+  }
+
+  func readFieldArray(buf *Buffer) ([]interface{}, error) {
+    size, err := buf.GetUint32()
+    if err != nil {
+      return nil, err
+    }
+    if buf.off+int(size) > len(buf.buf) {
+      return nil, io.ErrUnexpectedEOF
+    }
+
+    end := buf.off + int(size)
+
+    var arr []interface{}
+    for buf.off < end {
+      tag, err := buf.GetUint8()
+      if err != nil {
+        return nil, err
+      }
+      v, err := readFieldValue(buf, tag)
+      if err != nil {
+        return nil, err
+      }
+      arr = append(arr, v)
+    }
+    return arr, nil
+  }
+
+  // writeFieldValue dispatches on v's Go type, writing its wire tag
+  // followed by its encoded value.
+  func writeFieldValue(buf *Buffer, v interface{}, deterministic bool) error {
+    switch val := v.(type) {
+    case nil:
+      buf.PutUint8(tagVoid)
+      return nil
+    case Table:
+      buf.PutUint8(tagTable)
+      return buf.putTable(val, deterministic)
+    case []interface{}:
+      buf.PutUint8(tagArray)
+      return writeFieldArray(buf, val, deterministic)
+    {{range .TableTypes}}
+    case {{.Go}}:
+      buf.PutUint8({{.Tag}})
+      return {{.Put}}(buf, val)
+    {{end}}
+    }
+    return fmt.Errorf("amqp: table value of type %T is not supported", v)
+  }
+
+  // readFieldValue dispatches on the wire tag already read from buf,
+  // decoding and returning the tagged value.
+  func readFieldValue(buf *Buffer, tag byte) (interface{}, error) {
+    switch tag {
+    case tagVoid:
+      return nil, nil
+    case tagTable:
+      return buf.GetTable()
+    case tagArray:
+      return readFieldArray(buf)
+    {{range .TableTypes}}
+    case {{.Tag}}:
+      return {{.Get}}(buf)
+    {{end}}
+    }
+    return nil, fmt.Errorf("amqp: unknown table value tag %q", tag)
+  }
+
+  func writeTableFields(buf *Buffer, t Table, deterministic bool) error {
+    keys := make([]string, 0, len(t))
+    for k := range t {
+      keys = append(keys, k)
+    }
+    if deterministic {
+      sort.Strings(keys)
+    }
+
+    for _, k := range keys {
+      if err := buf.PutShortstr(k); err != nil {
+        return err
+      }
+      if err := writeFieldValue(buf, t[k], deterministic); err != nil {
+        return err
+      }
+    }
+    return nil
+  }
+
+  func readTableFields(buf *Buffer, end int) (Table, error) {
+    t := make(Table)
+    for buf.off < end {
+      key, err := buf.GetShortstr()
+      if err != nil {
+        return nil, err
+      }
+      tag, err := buf.GetUint8()
+      if err != nil {
+        return nil, err
+      }
+      v, err := readFieldValue(buf, tag)
+      if err != nil {
+        return nil, err
+      }
+      t[key] = v
+    }
+    return t, nil
+  }
+
+  // MarshalDeterministic encodes t the same as Buffer.PutTable, except
+  // map keys are sorted lexicographically first, so the same Table value
+  // always produces identical bytes. Useful for reproducible frames,
+  // replay tests, and content-hash-based dedup.
+  func (t Table) MarshalDeterministic() ([]byte, error) {
+    buf := &Buffer{}
+    if err := buf.putTable(t, true); err != nil {
+      return nil, err
+    }
+    return buf.buf, nil
+  }
+  `))
 )
 
 func (me *renderer) Partial(prefix string, fields []fieldset) (s string, err error) {
@@ -358,22 +1048,42 @@ func (me *renderer) Fieldsets(fields []Field) (f []fieldset, err error) {
 
   if len(tmp) > 0 {
     acc := tmp[0]
-    for i, cur := range tmp[1:] {
+    for _, cur := range tmp[1:] {
       if acc.AmqpType == cur.AmqpType {
         acc.Fields = append(acc.Fields, cur.Fields...)
-        if i == len(tmp) {
-          f = append(f, acc)
-        }
       } else {
         f = append(f, acc)
         acc = cur
       }
     }
+    // flush the last accumulated group, which the loop above never sees
+    // because there's no following fieldset to force it out
+    f = append(f, acc)
   }
 
   return
 }
 
+// ResponseMethodId resolves method's <response> to the method id of the
+// matching method in class, or 0 if method declares no response. The
+// spec always names a response method in the same class as the method
+// it answers.
+func (me *renderer) ResponseMethodId(class Class, method Method) (uint16, error) {
+  if method.Response.Name == "" {
+    return 0, nil
+  }
+  for _, candidate := range class.Methods {
+    if candidate.Name == method.Response.Name {
+      id, err := strconv.Atoi(candidate.Index)
+      if err != nil {
+        return 0, err
+      }
+      return uint16(id), nil
+    }
+  }
+  return 0, fmt.Errorf("amqp: %s.%s declares unknown response method %q", class.Name, method.Name, method.Response.Name)
+}
+
 func (me *renderer) HasField(field string, method Method) bool {
 	for _, f := range method.Fields {
 		name := me.FieldName(f)
@@ -384,80 +1094,6 @@ func (me *renderer) HasField(field string, method Method) bool {
 	return false
 }
 
-func (me *renderer) FieldEncode(field Field) (str string, err error) {
-  var fieldType, nativeType, fieldName string
-
-  if fieldType, err = me.FieldType(field); err != nil {
-    return "", err
-  }
-
-  if nativeType, err = me.NativeType(fieldType); err != nil {
-    return "", err
-  }
-
-  if field.Reserved {
-    fieldName = camel(field.Name)
-    str += fmt.Sprintf("var %s %s\n", fieldName, nativeType)
-  } else {
-    fieldName = fmt.Sprintf("me.%s", camel(field.Name))
-  }
-
-  if fieldType == "bit" {
-    if me.bitcounter == 0 {
-      str += fmt.Sprintf("buf.PutOctet(0)\n")
-    }
-    str += fmt.Sprintf("buf.Put%s(%s, %d)", camel(fieldType), fieldName, me.bitcounter)
-    me.bitcounter = me.bitcounter + 1
-    return
-  }
-
-  me.bitcounter = 0
-  str += fmt.Sprintf("buf.Put%s(%s)", camel(fieldType), fieldName)
-
-  return
-}
-
-func (me *renderer) FinishDecode() (string, error) {
-  if me.bitcounter > 0 {
-    me.bitcounter = 0
-    // The last field in the fieldset was a bit field
-    // which means we need to consume this word.  This would
-    // be better done with object scoping
-    return "me.NextOctet()", nil
-  }
-  return "", nil
-}
-
-func (me *renderer) FieldDecode(name string, field Field) (string, error) {
-  var str string
-
-  t, err := me.FieldType(field)
-  if err != nil {
-    return "", err
-  }
-
-  if field.Reserved {
-    str = "_ = "
-  } else {
-    str = fmt.Sprintf("%s.%s = ", name, camel(field.Name))
-  }
-
-  if t == "bit" {
-    str += fmt.Sprintf("me.Next%s(%d)", camel(t), me.bitcounter)
-    me.bitcounter = me.bitcounter + 1
-    return str, nil
-  }
-
-  if me.bitcounter > 0 {
-    // We've advanced past a bit word, so consume it before the real decoding
-    str = "me.NextOctet() // reset\n" + str
-    me.bitcounter = 0
-  }
-
-  return str + fmt.Sprintf("me.Next%s()", camel(t)), nil
-
-}
-
 func (me *renderer) Domain(field Field) (domain Domain, err error) {
   for _, domain = range me.Root.Domains {
     if field.Domain == domain.Name {
@@ -500,6 +1136,33 @@ func (me *renderer) NativeType(amqpType string) (t string, err error) {
   return "", ErrUnknownType
 }
 
+// NeedsTime reports whether any method field in the spec resolves to the
+// timestamp type, so spec091.go only imports "time" when it actually
+// declares a time.Time field. AMQP 0-9-1 has no timestamp-typed method
+// field in the stock spec, so this is usually false.
+func (me *renderer) NeedsTime() (bool, error) {
+  for _, class := range me.Root.Classes {
+    for _, method := range class.Methods {
+      for _, field := range method.Fields {
+        t, err := me.FieldType(field)
+        if err != nil {
+          return false, err
+        }
+        if t == "timestamp" {
+          return true, nil
+        }
+      }
+    }
+  }
+  return false, nil
+}
+
+// TableTypes returns the field-table value tags that table.go's codec is
+// generated from.
+func (me *renderer) TableTypes() []tableType {
+  return tableTypes
+}
+
 func (me *renderer) Tag(d Domain) string {
   label := "`"
 
@@ -536,7 +1199,252 @@ func camel(parts ...string) (res string) {
   return
 }
 
+// atoi16 parses a spec index attribute, which is always a small decimal
+// number, into the uint16 the generated code represents it as.
+func atoi16(s string) uint16 {
+  n, _ := strconv.Atoi(s)
+  return uint16(n)
+}
+
+// fuzzValue returns the wire encoding of a zero value (maximal == false)
+// or a type-appropriate boundary value (maximal == true) for amqpType.
+// Bit fields are handled by the caller, since they pack into a shared
+// octet rather than encoding independently.
+func fuzzValue(amqpType string, maximal bool) []byte {
+  switch amqpType {
+  case "octet", "shortshort":
+    if maximal {
+      return []byte{0xff}
+    }
+    return []byte{0x00}
+  case "short":
+    if maximal {
+      return []byte{0xff, 0xff}
+    }
+    return []byte{0x00, 0x00}
+  case "long":
+    if maximal {
+      return []byte{0xff, 0xff, 0xff, 0xff}
+    }
+    return []byte{0x00, 0x00, 0x00, 0x00}
+  case "longlong", "timestamp":
+    if maximal {
+      return bytes.Repeat([]byte{0xff}, 8)
+    }
+    return bytes.Repeat([]byte{0x00}, 8)
+  case "shortstr":
+    if maximal {
+      return append([]byte{0xff}, bytes.Repeat([]byte("x"), 255)...)
+    }
+    return []byte{0x00}
+  case "longstr":
+    if maximal {
+      s := bytes.Repeat([]byte("x"), 8)
+      prefix := make([]byte, 4)
+      binary.BigEndian.PutUint32(prefix, uint32(len(s)))
+      return append(prefix, s...)
+    }
+    return []byte{0x00, 0x00, 0x00, 0x00}
+  case "table":
+    if maximal {
+      return fuzzTableOneOfEach()
+    }
+    return []byte{0x00, 0x00, 0x00, 0x00}
+  }
+  return nil
+}
+
+// fuzzScalarValue returns a boundary-value wire encoding for a field-table
+// scalar of the given Go type, as cataloged in tableTypes.
+func fuzzScalarValue(goType string) []byte {
+  switch goType {
+  case "bool":
+    return []byte{0x01}
+  case "int8", "uint8":
+    return []byte{0xff}
+  case "int16", "uint16":
+    return []byte{0xff, 0xff}
+  case "int32", "uint32":
+    return []byte{0xff, 0xff, 0xff, 0xff}
+  case "float32":
+    return []byte{0x7f, 0x7f, 0xff, 0xff} // math.MaxFloat32, not NaN
+  case "int64", "time.Time":
+    return bytes.Repeat([]byte{0xff}, 8)
+  case "float64":
+    return []byte{0x7f, 0xef, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff} // math.MaxFloat64, not NaN
+  case "Decimal":
+    return []byte{0xff, 0xff, 0xff, 0xff, 0xff} // scale octet + long-int value
+  case "string":
+    return []byte{0x00, 0x00, 0x00, 0x01, 'x'}
+  case "[]byte":
+    return []byte{0x00, 0x00, 0x00, 0x01, 'x'}
+  }
+  return nil
+}
+
+// fuzzTableOneOfEach returns a wire-encoded Table containing one entry for
+// every tag in tableTypes plus void, nested-table, and array, so a single
+// golden frame exercises the whole field-table type system.
+func fuzzTableOneOfEach() []byte {
+  var body bytes.Buffer
+
+  putEntry := func(key string, tag byte, value []byte) {
+    body.WriteByte(byte(len(key)))
+    body.WriteString(key)
+    body.WriteByte(tag)
+    body.Write(value)
+  }
+
+  for _, tt := range tableTypes {
+    putEntry(tt.Go, tt.Tag[1], fuzzScalarValue(tt.Go))
+  }
+  putEntry("void", 'V', nil)
+  putEntry("table", 'F', []byte{0x00, 0x00, 0x00, 0x00})
+  putEntry("array", 'A', []byte{0x00, 0x00, 0x00, 0x05, 'I', 0x00, 0x00, 0x00, 0x01})
+
+  prefix := make([]byte, 4)
+  binary.BigEndian.PutUint32(prefix, uint32(body.Len()))
+  return append(prefix, body.Bytes()...)
+}
+
+// buildFrame encodes class/method's header and fields into a single
+// method-frame payload, using either zero values or type-appropriate
+// boundary values for every field.
+func buildFrame(r *renderer, class Class, method Method, maximal bool) ([]byte, error) {
+  var out bytes.Buffer
+
+  classId, methodId := atoi16(class.Index), atoi16(method.Index)
+  out.WriteByte(byte(classId >> 8))
+  out.WriteByte(byte(classId))
+  out.WriteByte(byte(methodId >> 8))
+  out.WriteByte(byte(methodId))
+
+  sets, err := r.Fieldsets(method.Fields)
+  if err != nil {
+    return nil, err
+  }
+
+  for _, set := range sets {
+    if set.AmqpType == "bit" {
+      var bits byte
+      if maximal {
+        for i := range set.Fields {
+          bits |= 1 << uint(i)
+        }
+      }
+      out.WriteByte(bits)
+      continue
+    }
+    for range set.Fields {
+      out.Write(fuzzValue(set.AmqpType, maximal))
+    }
+  }
+
+  return out.Bytes(), nil
+}
+
+func byteLiteral(data []byte) string {
+  parts := make([]string, len(data))
+  for i, b := range data {
+    parts[i] = fmt.Sprintf("0x%02x", b)
+  }
+  return strings.Join(parts, ", ")
+}
+
+// fuzzRoundTrip is the body of the FuzzParseMethodFrame_<Class> target
+// emitted into every per-class fuzz test file: it parses a method frame the same way
+// Framer.parseMethodFrame does, re-encodes it, and asserts that re-parsing
+// the re-encoded bytes yields an identical method. Comparing decoded
+// structs rather than raw bytes is deliberate: Table fields round-trip
+// through a Go map, so PutTable (unlike MarshalDeterministic) makes no
+// promise about the byte order of the re-encoded frame.
+const fuzzRoundTrip = `		buf := NewBuffer(data)
+		classId, err := buf.GetUint16()
+		if err != nil {
+			return
+		}
+		methodId, err := buf.GetUint16()
+		if err != nil {
+			return
+		}
+		method, ok := NewMethod(classId, methodId)
+		if !ok {
+			return
+		}
+		if err := method.read(buf); err != nil {
+			return
+		}
+
+		out := &Buffer{}
+		if err := method.write(out); err != nil {
+			t.Fatalf("write after successful read: %v", err)
+		}
+
+		reread, ok := NewMethod(classId, methodId)
+		if !ok {
+			t.Fatalf("NewMethod(%d, %d) failed for a method we just read", classId, methodId)
+		}
+		if err := reread.read(NewBuffer(out.buf)); err != nil {
+			t.Fatalf("read of re-encoded frame: %v", err)
+		}
+
+		if !reflect.DeepEqual(method, reread) {
+			t.Fatalf("round-trip mismatch for class %d method %d:\n got  %#v\n want %#v", classId, methodId, reread, method)
+		}
+`
+
+// writeFuzzCorpus emits, per class, one golden frame per method per
+// minimal/maximal case plus a _test.go registering them as fuzz seeds for
+// that class's FuzzParseMethodFrame_<Class> target.
+func writeFuzzCorpus(dir string, r *renderer) error {
+  if err := os.MkdirAll(dir, 0755); err != nil {
+    return err
+  }
+
+  for _, class := range r.Root.Classes {
+    var test bytes.Buffer
+    fmt.Fprintf(&test, "package amqp\n\nimport (\n\t\"reflect\"\n\t\"testing\"\n)\n\nfunc FuzzParseMethodFrame_%s(f *testing.F) {\n", camel(class.Name))
+
+    for _, method := range class.Methods {
+      for _, maximal := range []bool{false, true} {
+        frame, err := buildFrame(r, class, method, maximal)
+        if err != nil {
+          return fmt.Errorf("%s.%s: %w", class.Name, method.Name, err)
+        }
+
+        kind := "min"
+        if maximal {
+          kind = "max"
+        }
+        name := fmt.Sprintf("%s_%s_%s", class.Name, method.Name, kind)
+
+        if err := ioutil.WriteFile(filepath.Join(dir, name+".golden"), frame, 0644); err != nil {
+          return err
+        }
+
+        fmt.Fprintf(&test, "\tf.Add([]byte{%s}) // %s\n", byteLiteral(frame), name)
+      }
+    }
+
+    fmt.Fprint(&test, "\n\tf.Fuzz(func(t *testing.T, data []byte) {\n")
+    test.WriteString(fuzzRoundTrip)
+    fmt.Fprint(&test, "\t})\n}\n")
+
+    path := filepath.Join(dir, fmt.Sprintf("fuzz_%s_test.go", class.Name))
+    if err := ioutil.WriteFile(path, test.Bytes(), 0644); err != nil {
+      return err
+    }
+  }
+
+  return nil
+}
+
+var renderTable = flag.Bool("table", false, "render table.go (the field-table codec) instead of the class/method bindings")
+var fuzzCorpusDir = flag.String("fuzz-corpus", "", "write a spec-derived fuzz corpus and golden frames to this directory, instead of printing generated source")
+
 func main() {
+  flag.Parse()
+
   var r renderer
 
   spec, err := ioutil.ReadAll(os.Stdin)
@@ -550,7 +1458,19 @@ func main() {
     log.Fatalln("Could not parse XML:", err)
   }
 
-  if err = packageTemplate.Execute(os.Stdout, &r); err != nil {
+  if *fuzzCorpusDir != "" {
+    if err := writeFuzzCorpus(*fuzzCorpusDir, &r); err != nil {
+      log.Fatalln("Fuzz corpus error:", err)
+    }
+    return
+  }
+
+  tmpl := packageTemplate
+  if *renderTable {
+    tmpl = tableTemplate
+  }
+
+  if err = tmpl.Execute(os.Stdout, &r); err != nil {
     log.Fatalln("Generate error: ", err)
   }
 }